@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// CorsPolicy describes the CORS behaviour for a group of routes.
+type CorsPolicy struct {
+	// AllowedOrigins lists the origins allowed to call the routes. "*" allows
+	// any origin, and cannot be combined with AllowCredentials.
+	AllowedOrigins []string
+	// AllowedMethods overrides the methods advertised to browsers. When empty,
+	// the methods registered on the matched route are used.
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	// ExposedHeaders lists the response headers browser scripts may read.
+	ExposedHeaders []string
+}
+
+// publicCorsPolicy is the default policy for the public website enquiry form,
+// which may be embedded on any site.
+var publicCorsPolicy = CorsPolicy{
+	AllowedOrigins: []string{"*"},
+	AllowedHeaders: []string{"Content-Type", formTokenHeader, idempotencyHeader},
+	ExposedHeaders: []string{
+		requestIDHeader,
+		"Retry-After",
+		"X-RateLimit-Limit",
+		"X-RateLimit-Remaining",
+		"X-RateLimit-Reset",
+		"Idempotent-Replayed",
+	},
+}
+
+// loadCorsPolicy applies environment overrides to a route group's default
+// policy. For prefix CORS_PUBLIC it reads CORS_PUBLIC_ALLOWED_ORIGINS,
+// CORS_PUBLIC_ALLOWED_METHODS, CORS_PUBLIC_ALLOWED_HEADERS and
+// CORS_PUBLIC_EXPOSED_HEADERS (comma separated) and
+// CORS_PUBLIC_ALLOW_CREDENTIALS (true/false).
+func loadCorsPolicy(prefix string, policy CorsPolicy) CorsPolicy {
+	if v := os.Getenv(prefix + "_ALLOWED_ORIGINS"); v != "" {
+		policy.AllowedOrigins = splitList(v)
+	}
+	if v := os.Getenv(prefix + "_ALLOWED_METHODS"); v != "" {
+		policy.AllowedMethods = splitList(v)
+	}
+	if v := os.Getenv(prefix + "_ALLOWED_HEADERS"); v != "" {
+		policy.AllowedHeaders = splitList(v)
+	}
+	if v := os.Getenv(prefix + "_EXPOSED_HEADERS"); v != "" {
+		policy.ExposedHeaders = splitList(v)
+	}
+	if v := os.Getenv(prefix + "_ALLOW_CREDENTIALS"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			slog.Warn("Invalid CORS setting, ignoring", "name", prefix+"_ALLOW_CREDENTIALS", "value", v)
+		} else {
+			policy.AllowCredentials = allow
+		}
+	}
+	// Credentials with any origin would let every site act as the user
+	if policy.AllowCredentials && policy.allowsAnyOrigin() {
+		slog.Warn("CORS credentials cannot be combined with any origin, disabling credentials", "name", prefix+"_ALLOW_CREDENTIALS")
+		policy.AllowCredentials = false
+	}
+	return policy
+}
+
+// allowsAnyOrigin reports whether AllowedOrigins contains "*".
+func (p CorsPolicy) allowsAnyOrigin() bool {
+	for _, o := range p.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated setting, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// allowMethods returns the methods to advertise for the request's route.
+func (p CorsPolicy) allowMethods(r *http.Request) []string {
+	if len(p.AllowedMethods) > 0 {
+		return p.AllowedMethods
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if methods, err := route.GetMethods(); err == nil {
+			return methods
+		}
+	}
+	return nil
+}
+
+// allowOrigin reports the value to send in Access-Control-Allow-Origin for the
+// given request origin, or "" if the origin is not allowed.
+func (p CorsPolicy) allowOrigin(origin string) string {
+	for _, o := range p.AllowedOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// CorsMiddleware returns a middleware applying the given policy. Route groups
+// that should not be reachable from browsers simply don't use it.
+func CorsMiddleware(policy CorsPolicy) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin != "" {
+				w.Header().Add("Vary", "Origin")
+				if allowed := policy.allowOrigin(origin); allowed != "" {
+					w.Header().Set("Access-Control-Allow-Origin", allowed)
+					w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.allowMethods(r), ", "))
+					w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+					if len(policy.ExposedHeaders) > 0 {
+						w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+					}
+					if policy.AllowCredentials {
+						w.Header().Set("Access-Control-Allow-Credentials", "true")
+					}
+				}
+			}
+
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const customFieldsCollection = "CustomFields"
+
+// Supported custom field types, matching the types produced by JSON decoding.
+const (
+	CustomFieldString  = "string"
+	CustomFieldNumber  = "number"
+	CustomFieldBoolean = "boolean"
+)
+
+// CustomFieldDefinition describes a customer-defined enquiry field.
+type CustomFieldDefinition struct {
+	Name     string `json:"name" bson:"name"`
+	Type     string `json:"type" bson:"type"`
+	Required bool   `json:"required" bson:"required"`
+}
+
+// CustomFieldRegistry provides the registered custom field definitions.
+type CustomFieldRegistry interface {
+	Definitions(ctx context.Context) ([]CustomFieldDefinition, error)
+}
+
+// mongoCustomFieldRegistry reads the definitions from the CustomFields collection.
+type mongoCustomFieldRegistry struct {
+	client *mongo.Client
+}
+
+func newMongoCustomFieldRegistry(client *mongo.Client) *mongoCustomFieldRegistry {
+	return &mongoCustomFieldRegistry{client: client}
+}
+
+func (registry *mongoCustomFieldRegistry) Definitions(ctx context.Context) ([]CustomFieldDefinition, error) {
+	collection := registry.client.Database(dbName).Collection(customFieldsCollection)
+	defs := []CustomFieldDefinition{}
+	err := withMongoRetry(ctx, func(ctx context.Context) error {
+		cursor, err := collection.Find(ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &defs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// memoryCustomFieldRegistry is a fixed set of definitions, for running
+// without MongoDB.
+type memoryCustomFieldRegistry []CustomFieldDefinition
+
+func (registry memoryCustomFieldRegistry) Definitions(ctx context.Context) ([]CustomFieldDefinition, error) {
+	return append([]CustomFieldDefinition{}, registry...), nil
+}
+
+// validateCustomFields checks submitted custom fields against the registry:
+// required fields must be present, values must match their declared type and
+// unknown fields are rejected.
+func validateCustomFields(fields map[string]interface{}, defs []CustomFieldDefinition) error {
+	known := make(map[string]CustomFieldDefinition, len(defs))
+	for _, def := range defs {
+		known[def.Name] = def
+		if _, ok := fields[def.Name]; def.Required && !ok {
+			return customFieldError(def.Name, "is required")
+		}
+	}
+	for name, value := range fields {
+		def, ok := known[name]
+		if !ok {
+			return customFieldError(name, "is not a known custom field")
+		}
+		if value == nil {
+			if def.Required {
+				return customFieldError(name, "is required")
+			}
+			continue
+		}
+		var valid bool
+		switch def.Type {
+		case CustomFieldString:
+			_, valid = value.(string)
+		case CustomFieldNumber:
+			_, valid = value.(float64)
+		case CustomFieldBoolean:
+			_, valid = value.(bool)
+		}
+		if !valid {
+			return customFieldError(name, "must be of type "+def.Type)
+		}
+	}
+	return nil
+}
+
+func customFieldError(name, message string) error {
+	return &RequestError{
+		Code:    ErrCodeValidation,
+		Message: "Validation failed",
+		Fields:  []FieldError{{Field: "custom_fields." + name, Message: message}},
+	}
+}
+
+// CustomFieldsHandler lists the custom field definitions so the website form
+// can render them.
+func CustomFieldsHandler(customFields CustomFieldRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defs, err := customFields.Definitions(r.Context())
+		if err != nil {
+			internalError(w, r, "Failed to load custom fields", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(defs)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DatabaseConfig holds the MongoDB client settings. Each can be overridden
+// with the environment variable noted beside it.
+type DatabaseConfig struct {
+	MaxPoolSize            uint64        // MONGO_MAX_POOL_SIZE
+	MinPoolSize            uint64        // MONGO_MIN_POOL_SIZE
+	ConnectTimeout         time.Duration // MONGO_CONNECT_TIMEOUT
+	SocketTimeout          time.Duration // MONGO_SOCKET_TIMEOUT, 0 for none
+	ServerSelectionTimeout time.Duration // MONGO_SERVER_SELECTION_TIMEOUT
+	RetryWrites            bool          // MONGO_RETRY_WRITES
+}
+
+// defaultDatabaseConfig fails fast enough for a request to report the error
+// well within requestTimeout. Operations are otherwise bounded by the request
+// deadline, so there is no socket timeout.
+var defaultDatabaseConfig = DatabaseConfig{
+	MaxPoolSize:            100,
+	MinPoolSize:            0,
+	ConnectTimeout:         10 * time.Second,
+	SocketTimeout:          0,
+	ServerSelectionTimeout: 5 * time.Second,
+	RetryWrites:            true,
+}
+
+// loadDatabaseConfig applies environment overrides to defaultDatabaseConfig.
+// Invalid values are logged and ignored.
+func loadDatabaseConfig() DatabaseConfig {
+	cfg := defaultDatabaseConfig
+	envUint("MONGO_MAX_POOL_SIZE", &cfg.MaxPoolSize)
+	envUint("MONGO_MIN_POOL_SIZE", &cfg.MinPoolSize)
+	envDuration("MONGO_CONNECT_TIMEOUT", &cfg.ConnectTimeout)
+	envDuration("MONGO_SOCKET_TIMEOUT", &cfg.SocketTimeout)
+	envDuration("MONGO_SERVER_SELECTION_TIMEOUT", &cfg.ServerSelectionTimeout)
+	if v := os.Getenv("MONGO_RETRY_WRITES"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err == nil {
+			cfg.RetryWrites = b
+		} else {
+			slog.Warn("Invalid MONGO_RETRY_WRITES, using default", "value", v)
+		}
+	}
+	return cfg
+}
+
+func envUint(name string, dst *uint64) {
+	if v := os.Getenv(name); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			slog.Warn("Invalid "+name+", using default", "value", v)
+			return
+		}
+		*dst = n
+	}
+}
+
+// envDuration sets *dst from the duration in the named variable, allowing 0.
+func envDuration(name string, dst *time.Duration) {
+	envDurationAtLeast(name, 0, dst)
+}
+
+// envPositiveDuration is envDuration for settings where 0 makes no sense.
+func envPositiveDuration(name string, dst *time.Duration) {
+	envDurationAtLeast(name, time.Nanosecond, dst)
+}
+
+func envDurationAtLeast(name string, min time.Duration, dst *time.Duration) {
+	if v := os.Getenv(name); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < min {
+			slog.Warn("Invalid "+name+", using default", "value", v)
+			return
+		}
+		*dst = d
+	}
+}
+
+// LogValue lets the effective settings be logged as one group.
+func (cfg DatabaseConfig) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("max_pool_size", cfg.MaxPoolSize),
+		slog.Uint64("min_pool_size", cfg.MinPoolSize),
+		slog.Duration("connect_timeout", cfg.ConnectTimeout),
+		slog.Duration("socket_timeout", cfg.SocketTimeout),
+		slog.Duration("server_selection_timeout", cfg.ServerSelectionTimeout),
+		slog.Bool("retry_writes", cfg.RetryWrites),
+	)
+}
+
+// connectMongo creates a MongoDB client with cfg and connects it. Settings in
+// cfg take precedence over those in mongoURI.
+func connectMongo(ctx context.Context, cfg DatabaseConfig) (*mongo.Client, error) {
+	opts := options.Client().ApplyURI(mongoURI).
+		SetMonitor(mongoCommandMonitor).
+		SetMaxPoolSize(cfg.MaxPoolSize).
+		SetMinPoolSize(cfg.MinPoolSize).
+		SetConnectTimeout(cfg.ConnectTimeout).
+		SetServerSelectionTimeout(cfg.ServerSelectionTimeout).
+		SetRetryWrites(cfg.RetryWrites)
+	if cfg.SocketTimeout > 0 {
+		opts.SetSocketTimeout(cfg.SocketTimeout)
+	}
+	client, err := mongo.NewClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Connect(ctx); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+)
+
+// initErrorReporting configures Sentry from SENTRY_DSN. Without a DSN error
+// reporting is disabled and the capture calls below are no-ops. Events are
+// tagged with SENTRY_RELEASE, falling back to the App Engine version.
+func initErrorReporting() error {
+	dsn := os.Getenv("SENTRY_DSN")
+	if dsn == "" {
+		return nil
+	}
+	release := os.Getenv("SENTRY_RELEASE")
+	if release == "" {
+		release = os.Getenv("GAE_VERSION")
+	}
+	return sentry.Init(sentry.ClientOptions{
+		Dsn:         dsn,
+		Release:     release,
+		Environment: os.Getenv("SENTRY_ENVIRONMENT"),
+		BeforeSend: func(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
+			// Enquiry bodies hold the submitter's personal details
+			if event.Request != nil {
+				event.Request.Data = ""
+			}
+			return event
+		},
+	})
+}
+
+// ErrorReportingMiddleware gives each request its own Sentry hub carrying the
+// request details, request ID and route, and turns panics into a reported
+// 500 response instead of a dropped connection.
+func ErrorReportingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub := sentry.CurrentHub().Clone()
+		hub.Scope().SetRequest(r)
+		hub.Scope().SetTag("request_id", w.Header().Get(requestIDHeader))
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+			hub.Scope().SetTag("route", route.GetName())
+		}
+		r = r.WithContext(sentry.SetHubOnContext(r.Context(), hub))
+
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			hub.RecoverWithContext(r.Context(), err)
+			loggerFrom(r.Context()).Error("Panic serving request", "panic", err, "stack", string(debug.Stack()))
+			writeError(w, ErrCodeInternal, "Internal server error", nil)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reportError sends err to Sentry with the request context attached by
+// ErrorReportingMiddleware.
+func reportError(ctx context.Context, level sentry.Level, msg string, err error) {
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		return
+	}
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetLevel(level)
+		hub.CaptureException(fmt.Errorf("%s: %w", msg, err))
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Error codes returned in ErrorResponse.Code. Clients branch on these, so an
+// existing code must never be renamed or reused for a different condition.
+const (
+	ErrCodeBadRequest       = "BAD_REQUEST"
+	ErrCodeInvalidJSON      = "INVALID_JSON"
+	ErrCodeValidation       = "VALIDATION_FAILED"
+	ErrCodeFormTokenInvalid = "FORM_TOKEN_INVALID"
+	ErrCodeFormTokenExpired = "FORM_TOKEN_EXPIRED"
+	ErrCodeFormTokenTooNew  = "FORM_TOKEN_TOO_NEW"
+	ErrCodeFormTokenUsed    = "FORM_TOKEN_USED"
+	ErrCodeEnquiryNotFound  = "ENQUIRY_NOT_FOUND"
+	ErrCodeRateLimited      = "RATE_LIMITED"
+
+	ErrCodeIdempotencyKeyInvalid = "IDEMPOTENCY_KEY_INVALID"
+	ErrCodeIdempotencyKeyReused  = "IDEMPOTENCY_KEY_REUSED"
+	ErrCodeIdempotencyInProgress = "IDEMPOTENCY_IN_PROGRESS"
+
+	ErrCodeTimeout  = "REQUEST_TIMEOUT"
+	ErrCodeInternal = "INTERNAL_ERROR"
+)
+
+// errorStatus is the registry of error codes and the HTTP status each one is
+// returned with.
+var errorStatus = map[string]int{
+	ErrCodeBadRequest:       http.StatusBadRequest,
+	ErrCodeInvalidJSON:      http.StatusBadRequest,
+	ErrCodeValidation:       http.StatusBadRequest,
+	ErrCodeFormTokenInvalid: http.StatusForbidden,
+	ErrCodeFormTokenExpired: http.StatusForbidden,
+	ErrCodeFormTokenTooNew:  http.StatusForbidden,
+	ErrCodeFormTokenUsed:    http.StatusForbidden,
+	ErrCodeEnquiryNotFound:  http.StatusNotFound,
+	ErrCodeRateLimited:      http.StatusTooManyRequests,
+
+	ErrCodeIdempotencyKeyInvalid: http.StatusBadRequest,
+	ErrCodeIdempotencyKeyReused:  http.StatusUnprocessableEntity,
+	ErrCodeIdempotencyInProgress: http.StatusConflict,
+
+	ErrCodeTimeout:  http.StatusServiceUnavailable,
+	ErrCodeInternal: http.StatusInternalServerError,
+}
+
+// ErrorResponse is the JSON envelope for every error returned by the API.
+type ErrorResponse struct {
+	Status  string       `json:"status"`
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Errors  []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes a problem with one request field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// RequestError is a client error, optionally with field-level details.
+type RequestError struct {
+	Code    string
+	Message string
+	Fields  []FieldError
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// writeError sends an ErrorResponse with the HTTP status registered for code.
+func writeError(w http.ResponseWriter, code string, message string, fields []FieldError) {
+	status, ok := errorStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Status:  "error",
+		Code:    code,
+		Message: message,
+		Errors:  fields,
+	})
+}
+
+// badRequest reports a client error, using the code and field details when
+// err is a *RequestError.
+func badRequest(w http.ResponseWriter, err error) {
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) {
+		code := reqErr.Code
+		if code == "" {
+			code = ErrCodeBadRequest
+		}
+		writeError(w, code, reqErr.Message, reqErr.Fields)
+		return
+	}
+	writeError(w, ErrCodeBadRequest, err.Error(), nil)
+}
+
+// internalError logs err with the request's logger and sends it to error
+// reporting. The client only gets msg; err stays server side, and the
+// X-Request-ID header ties the response to the log line. Errors caused by the request
+// deadline or a disconnected client are reported as 503 Service Unavailable
+// rather than as server faults.
+func internalError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	if ctxErr := r.Context().Err(); ctxErr != nil {
+		loggerFrom(r.Context()).Warn(msg, "error", err, "cause", ctxErr)
+		reportError(r.Context(), sentry.LevelWarning, msg, err)
+		writeError(w, ErrCodeTimeout, "Request timed out", nil)
+		return
+	}
+	loggerFrom(r.Context()).Error(msg, "error", err)
+	reportError(r.Context(), sentry.LevelError, msg, err)
+	writeError(w, ErrCodeInternal, msg, nil)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Form token configuration
+const (
+	formTokenHeader     = "X-Form-Token"
+	formTokenTTL        = 30 * time.Minute
+	formTokenMinAge     = 2 * time.Second // forms submitted faster than this are almost certainly bots
+	formTokenCollection = "FormTokens"
+)
+
+var (
+	errFormTokenInvalid = errors.New("invalid form token")
+	errFormTokenExpired = errors.New("form token expired")
+	errFormTokenTooNew  = errors.New("form submitted too quickly")
+	errFormTokenUsed    = errors.New("form token already used")
+)
+
+// formTokenErrorCode returns the API error code for a form token error.
+func formTokenErrorCode(err error) string {
+	switch err {
+	case errFormTokenExpired:
+		return ErrCodeFormTokenExpired
+	case errFormTokenTooNew:
+		return ErrCodeFormTokenTooNew
+	case errFormTokenUsed:
+		return ErrCodeFormTokenUsed
+	default:
+		return ErrCodeFormTokenInvalid
+	}
+}
+
+// formTokenSecret signs form tokens. It is read from FORM_TOKEN_SECRET so that
+// all instances accept each other's tokens. It is loaded in main once logging
+// is configured.
+var formTokenSecret []byte
+
+// errFormTokenSecretRequired is returned by loadFormTokenSecret on App Engine,
+// where requests are spread over instances that come and go.
+var errFormTokenSecretRequired = errors.New("FORM_TOKEN_SECRET must be set on App Engine")
+
+// loadFormTokenSecret reads FORM_TOKEN_SECRET. Outside App Engine a random
+// per-process secret is used when it is unset, which is enough for a single
+// local instance.
+func loadFormTokenSecret() ([]byte, error) {
+	if s := os.Getenv("FORM_TOKEN_SECRET"); s != "" {
+		return []byte(s), nil
+	}
+	if os.Getenv("GAE_ENV") != "" || os.Getenv("GAE_SERVICE") != "" {
+		return nil, errFormTokenSecretRequired
+	}
+	slog.Warn("FORM_TOKEN_SECRET not set; using a random secret, form tokens will only be valid on this instance")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// newFormToken returns a signed token of the form base64(nonce|issuedAt).base64(hmac).
+func newFormToken(now time.Time) (string, error) {
+	payload := make([]byte, 16+8)
+	if _, err := rand.Read(payload[:16]); err != nil {
+		return "", err
+	}
+	binary.BigEndian.PutUint64(payload[16:], uint64(now.Unix()))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signFormToken(payload)), nil
+}
+
+func signFormToken(payload []byte) []byte {
+	mac := hmac.New(sha256.New, formTokenSecret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// verifyFormToken checks the token signature and age and returns its nonce.
+func verifyFormToken(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", errFormTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(payload) != 16+8 {
+		return "", errFormTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, signFormToken(payload)) {
+		return "", errFormTokenInvalid
+	}
+	issuedAt := time.Unix(int64(binary.BigEndian.Uint64(payload[16:])), 0)
+	if now.After(issuedAt.Add(formTokenTTL)) {
+		return "", errFormTokenExpired
+	}
+	if now.Before(issuedAt.Add(formTokenMinAge)) {
+		return "", errFormTokenTooNew
+	}
+	return hex.EncodeToString(payload[:16]), nil
+}
+
+// FormTokenStore records used form token nonces so each token is accepted once.
+type FormTokenStore interface {
+	// Consume records nonce as used, or returns errFormTokenUsed if it
+	// already was.
+	Consume(ctx context.Context, nonce string, now time.Time) error
+}
+
+// mongoFormTokenStore keeps used nonces in the FormTokens collection. The
+// nonce is the document _id, so a replayed token fails with a duplicate key
+// error.
+type mongoFormTokenStore struct {
+	client *mongo.Client
+}
+
+func newMongoFormTokenStore(client *mongo.Client) *mongoFormTokenStore {
+	return &mongoFormTokenStore{client: client}
+}
+
+func (store *mongoFormTokenStore) Consume(ctx context.Context, nonce string, now time.Time) error {
+	collection := store.client.Database(dbName).Collection(formTokenCollection)
+	_, err := collection.InsertOne(ctx, bson.M{"_id": nonce, "expires_at": now.Add(formTokenTTL)})
+	if mongo.IsDuplicateKeyError(err) {
+		return errFormTokenUsed
+	}
+	return err
+}
+
+// memoryFormTokenStore keeps used nonces in memory until their token expires.
+type memoryFormTokenStore struct {
+	mu   sync.Mutex
+	used map[string]time.Time // nonce -> expiry
+}
+
+func newMemoryFormTokenStore() *memoryFormTokenStore {
+	return &memoryFormTokenStore{used: make(map[string]time.Time)}
+}
+
+func (store *memoryFormTokenStore) Consume(ctx context.Context, nonce string, now time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for n, expiresAt := range store.used {
+		if now.After(expiresAt) {
+			delete(store.used, n)
+		}
+	}
+	if _, ok := store.used[nonce]; ok {
+		return errFormTokenUsed
+	}
+	store.used[nonce] = now.Add(formTokenTTL)
+	return nil
+}
+
+// ensureFormTokenIndex creates the TTL index that expires used nonces once the
+// token could no longer be valid anyway.
+func ensureFormTokenIndex(ctx context.Context, client *mongo.Client) error {
+	collection := client.Database(dbName).Collection(formTokenCollection)
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// FormTokenHandler issues a short-lived signed token for the website enquiry form.
+func FormTokenHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	token, err := newFormToken(now)
+	if err != nil {
+		internalError(w, r, "Failed to generate form token", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_at": now.Add(formTokenTTL).UTC(),
+	})
+}
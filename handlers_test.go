@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRouter returns a router backed by newMemoryStores, with an in-memory
+// rate limiter. Each test gets its own so rate limits don't carry over.
+func newTestRouter(t *testing.T, customFields ...CustomFieldDefinition) http.Handler {
+	t.Helper()
+	return newTestRouterWithStores(t, newMemoryStores(customFields...))
+}
+
+// newTestRouterWithStores is newTestRouter for tests that need to reach into
+// the stores.
+func newTestRouterWithStores(t *testing.T, stores Stores) http.Handler {
+	t.Helper()
+	formTokenSecret = []byte("test-secret")
+	return newRouter(stores, nil)
+}
+
+// testFormToken mints a form token old enough to pass formTokenMinAge.
+func testFormToken(t *testing.T) string {
+	t.Helper()
+	token, err := newFormToken(time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("newFormToken: %v", err)
+	}
+	return token
+}
+
+const testEnquiry = `{
+	"first_name": "Ada",
+	"email": "ada@example.com",
+	"enquiry_type": "Sales",
+	"message": "Please call me back"
+}`
+
+func submitEnquiry(t *testing.T, router http.Handler, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return submitEnquiryWithKey(t, router, token, "", body)
+}
+
+// submitEnquiryWithKey submits with an Idempotency-Key, if key is set.
+func submitEnquiryWithKey(t *testing.T, router http.Handler, token, key, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/enquiry", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(formTokenHeader, token)
+	if key != "" {
+		req.Header.Set(idempotencyHeader, key)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+}
+
+func TestEnquirySubmitAndStatus(t *testing.T) {
+	router := newTestRouter(t)
+
+	rec := submitEnquiry(t, router, testFormToken(t), testEnquiry)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("submit: got status %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	var created struct {
+		Status    string `json:"status"`
+		Reference string `json:"reference"`
+	}
+	decodeBody(t, rec, &created)
+	want := fmt.Sprintf("%s-%d-00001", referencePrefix, time.Now().UTC().Year())
+	if created.Status != "success" || created.Reference != want {
+		t.Fatalf("submit: got %+v, want success with reference %s", created, want)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/enquiry/status/"+created.Reference, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status: got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var status EnquiryStatus
+	decodeBody(t, rec, &status)
+	if status.Reference != created.Reference || status.Status != EnquiryStatusNew {
+		t.Fatalf("status: got %+v, want %s with status %s", status, created.Reference, EnquiryStatusNew)
+	}
+}
+
+func TestEnquiryStatusNotFound(t *testing.T) {
+	router := newTestRouter(t)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/enquiry/status/RGP-2000-99999", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusNotFound, rec.Body)
+	}
+	var resp ErrorResponse
+	decodeBody(t, rec, &resp)
+	if resp.Code != ErrCodeEnquiryNotFound {
+		t.Fatalf("got code %s, want %s", resp.Code, ErrCodeEnquiryNotFound)
+	}
+}
+
+func TestEnquiryReplayedFormToken(t *testing.T) {
+	router := newTestRouter(t)
+	token := testFormToken(t)
+
+	if rec := submitEnquiry(t, router, token, testEnquiry); rec.Code != http.StatusCreated {
+		t.Fatalf("first submit: got status %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	rec := submitEnquiry(t, router, token, testEnquiry)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("replay: got status %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+	var resp ErrorResponse
+	decodeBody(t, rec, &resp)
+	if resp.Code != ErrCodeFormTokenUsed {
+		t.Fatalf("replay: got code %s, want %s", resp.Code, ErrCodeFormTokenUsed)
+	}
+}
+
+func TestEnquiryCustomFieldValidation(t *testing.T) {
+	router := newTestRouter(t, CustomFieldDefinition{Name: "budget", Type: CustomFieldNumber, Required: true})
+	token := testFormToken(t)
+
+	rec := submitEnquiry(t, router, token, testEnquiry)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+	}
+	var resp ErrorResponse
+	decodeBody(t, rec, &resp)
+	if resp.Code != ErrCodeValidation || len(resp.Errors) != 1 || resp.Errors[0].Field != "custom_fields.budget" {
+		t.Fatalf("got %+v, want %s on custom_fields.budget", resp, ErrCodeValidation)
+	}
+
+	// A rejected submission doesn't use up the token
+	body := strings.Replace(testEnquiry, "{", `{"custom_fields": {"budget": 5000},`, 1)
+	if rec := submitEnquiry(t, router, token, body); rec.Code != http.StatusCreated {
+		t.Fatalf("corrected submit: got status %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+}
+
+func TestEnquiryIdempotentReplay(t *testing.T) {
+	router := newTestRouter(t)
+	token := testFormToken(t)
+
+	first := submitEnquiryWithKey(t, router, token, "key-1", testEnquiry)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first submit: got status %d, want %d: %s", first.Code, http.StatusCreated, first.Body)
+	}
+	// The replay is answered from the stored response, so the used token
+	// doesn't matter
+	replay := submitEnquiryWithKey(t, router, token, "key-1", testEnquiry)
+	if replay.Code != http.StatusCreated {
+		t.Fatalf("replay: got status %d, want %d: %s", replay.Code, http.StatusCreated, replay.Body)
+	}
+	if got := replay.Header().Get("Idempotent-Replayed"); got != "true" {
+		t.Fatalf("replay: got Idempotent-Replayed %q, want true", got)
+	}
+	if replay.Body.String() != first.Body.String() {
+		t.Fatalf("replay: got body %s, want %s", replay.Body, first.Body)
+	}
+}
+
+func TestEnquiryIdempotencyKeyReused(t *testing.T) {
+	router := newTestRouter(t)
+
+	if rec := submitEnquiryWithKey(t, router, testFormToken(t), "key-1", testEnquiry); rec.Code != http.StatusCreated {
+		t.Fatalf("first submit: got status %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	body := strings.Replace(testEnquiry, "Please call me back", "Please email me instead", 1)
+	rec := submitEnquiryWithKey(t, router, testFormToken(t), "key-1", body)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusUnprocessableEntity, rec.Body)
+	}
+	var resp ErrorResponse
+	decodeBody(t, rec, &resp)
+	if resp.Code != ErrCodeIdempotencyKeyReused {
+		t.Fatalf("got code %s, want %s", resp.Code, ErrCodeIdempotencyKeyReused)
+	}
+}
+
+func TestEnquiryIdempotencyInProgress(t *testing.T) {
+	stores := newMemoryStores()
+	router := newTestRouterWithStores(t, stores)
+
+	// Reserve the key as the middleware would for a request still running
+	sum := sha256.Sum256([]byte(testEnquiry))
+	if _, err := stores.Idempotency.Reserve(context.Background(), "POST /enquiry key-1", hex.EncodeToString(sum[:])); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	rec := submitEnquiryWithKey(t, router, testFormToken(t), "key-1", testEnquiry)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+	}
+	var resp ErrorResponse
+	decodeBody(t, rec, &resp)
+	if resp.Code != ErrCodeIdempotencyInProgress {
+		t.Fatalf("got code %s, want %s", resp.Code, ErrCodeIdempotencyInProgress)
+	}
+}
+
+func TestEnquiryIdempotencyKeyReleasedAfterClientError(t *testing.T) {
+	router := newTestRouter(t)
+
+	if rec := submitEnquiryWithKey(t, router, "not-a-token", "key-1", testEnquiry); rec.Code != http.StatusForbidden {
+		t.Fatalf("first submit: got status %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+	// The same request with a valid token is processed, not replayed
+	rec := submitEnquiryWithKey(t, router, testFormToken(t), "key-1", testEnquiry)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("retry: got status %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	if got := rec.Header().Get("Idempotent-Replayed"); got != "" {
+		t.Fatalf("retry: got Idempotent-Replayed %q, want none", got)
+	}
+}
+
+func TestEnquiryRateLimited(t *testing.T) {
+	router := newTestRouter(t)
+	limit := routeRateLimits["enquiry"]
+
+	// Rejected submissions count towards the limit too
+	for i := 0; i < limit.Burst; i++ {
+		if rec := submitEnquiry(t, router, "", testEnquiry); rec.Code != http.StatusForbidden {
+			t.Fatalf("request %d: got status %d, want %d: %s", i+1, rec.Code, http.StatusForbidden, rec.Body)
+		}
+	}
+	rec := submitEnquiry(t, router, "", testEnquiry)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusTooManyRequests, rec.Body)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("missing Retry-After header")
+	}
+	var resp ErrorResponse
+	decodeBody(t, rec, &resp)
+	if resp.Code != ErrCodeRateLimited {
+		t.Fatalf("got code %s, want %s", resp.Code, ErrCodeRateLimited)
+	}
+}
+
+func TestEnquiryCorsPreflight(t *testing.T) {
+	router := newTestRouter(t)
+
+	req := httptest.NewRequest(http.MethodOptions, "/enquiry", nil)
+	req.Header.Set("Origin", "https://www.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "content-type,x-form-token")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":   "*",
+		"Access-Control-Allow-Methods":  http.MethodPost,
+		"Access-Control-Allow-Headers":  formTokenHeader,
+		"Access-Control-Expose-Headers": "Retry-After",
+	} {
+		if got := rec.Header().Get(header); !strings.Contains(got, want) {
+			t.Errorf("got %s %q, want it to include %q", header, got, want)
+		}
+	}
+	// Preflights aren't rate limited
+	if got := rec.Header().Get("X-RateLimit-Limit"); got != "" {
+		t.Errorf("got X-RateLimit-Limit %q on a preflight, want none", got)
+	}
+}
+
+func TestLoadSLAConfig(t *testing.T) {
+	t.Setenv("SLA_DEFAULT_TARGET", "36h")
+	t.Setenv("SLA_TARGETS", "  Sales  =12h, billing = 24h, no-duration, Support=-1h, =1h")
+
+	cfg := loadSLAConfig()
+	if cfg.Default != 36*time.Hour {
+		t.Errorf("got default %s, want 36h", cfg.Default)
+	}
+	want := map[string]time.Duration{
+		"general inquiry": 48 * time.Hour, // from defaultSLAConfig
+		"sales":           12 * time.Hour, // overridden
+		"billing":         24 * time.Hour, // added
+		"support":         8 * time.Hour,  // invalid override ignored
+	}
+	if len(cfg.Targets) != len(want) {
+		t.Errorf("got targets %v, want %v", cfg.Targets, want)
+	}
+	for enquiryType, d := range want {
+		if cfg.Targets[enquiryType] != d {
+			t.Errorf("got %q target %s, want %s", enquiryType, cfg.Targets[enquiryType], d)
+		}
+	}
+	if defaultSLAConfig.Targets["sales"] != 24*time.Hour {
+		t.Error("loadSLAConfig modified defaultSLAConfig")
+	}
+}
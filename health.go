@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// healthCheckTimeout bounds each dependency check in the readiness probe.
+const healthCheckTimeout = 2 * time.Second
+
+// Health statuses
+const (
+	HealthOK          = "ok"
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+)
+
+// ComponentHealth is the result of checking one dependency. The probe is
+// public, so errors are only logged, never returned.
+type ComponentHealth struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// HealthLiveHandler reports that the process is up and serving requests.
+func HealthLiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, map[string]interface{}{"status": HealthOK})
+}
+
+// healthCheck checks one dependency. The API cannot serve requests without a
+// required one; without an optional one it runs degraded.
+type healthCheck struct {
+	check    func(ctx context.Context) error
+	required bool
+}
+
+// HealthReadyHandler checks the API's dependencies and returns 503 if a
+// required one is unavailable. pingDB checks the database. Redis is optional,
+// the rate limiter fails open without it, so it can only make the API degraded.
+func HealthReadyHandler(pingDB func(ctx context.Context) error, redisClient *redis.Client) http.HandlerFunc {
+	checks := map[string]healthCheck{
+		"mongodb": {check: pingDB, required: true},
+	}
+	if redisClient != nil {
+		checks["rate_limit_redis"] = healthCheck{check: func(ctx context.Context) error {
+			return redisClient.Ping(ctx).Err()
+		}}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		components := make(map[string]ComponentHealth, len(checks))
+		for name, check := range checks {
+			wg.Add(1)
+			go func(name string, check func(ctx context.Context) error) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+				defer cancel()
+
+				start := time.Now()
+				err := check(ctx)
+				result := ComponentHealth{Status: HealthOK, LatencyMS: time.Since(start).Milliseconds()}
+				if err != nil {
+					result.Status = HealthUnavailable
+					loggerFrom(r.Context()).Warn("Readiness check failed", "component", name, "error", err)
+				}
+
+				mu.Lock()
+				components[name] = result
+				mu.Unlock()
+			}(name, check.check)
+		}
+		wg.Wait()
+
+		status, code := HealthOK, http.StatusOK
+		for name, c := range components {
+			switch {
+			case c.Status == HealthOK:
+			case checks[name].required:
+				status, code = HealthUnavailable, http.StatusServiceUnavailable
+			case status == HealthOK:
+				status = HealthDegraded
+			}
+		}
+		writeHealth(w, code, map[string]interface{}{
+			"status":     status,
+			"components": components,
+		})
+	}
+}
+
+func writeHealth(w http.ResponseWriter, code int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Idempotency configuration
+const (
+	idempotencyHeader     = "Idempotency-Key"
+	idempotencyCollection = "IdempotencyKeys"
+	idempotencyTTL        = 24 * time.Hour
+	idempotencyMaxKeyLen  = 255
+	// A request still "processing" after this long is assumed to have died
+	// and its key may be retried.
+	idempotencyLockTTL = 2 * requestTimeout
+)
+
+// idempotencyRecord stores the first response for an Idempotency-Key.
+type idempotencyRecord struct {
+	ID          string    `bson:"_id"`
+	RequestHash string    `bson:"request_hash"`
+	Completed   bool      `bson:"completed"`
+	StatusCode  int       `bson:"status_code,omitempty"`
+	ContentType string    `bson:"content_type,omitempty"`
+	Body        []byte    `bson:"body,omitempty"`
+	ExpiresAt   time.Time `bson:"expires_at"`
+}
+
+// ensureIdempotencyIndex creates the TTL index that expires stored responses.
+func ensureIdempotencyIndex(ctx context.Context, client *mongo.Client) error {
+	collection := client.Database(dbName).Collection(idempotencyCollection)
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// IdempotencyStore keeps Idempotency-Key reservations and the responses
+// stored for them.
+type IdempotencyStore interface {
+	// Reserve claims id for a request with the given hash. If id is already
+	// taken it returns the existing record instead; expired records count as
+	// free, whether or not they have been removed yet.
+	Reserve(ctx context.Context, id, requestHash string) (*idempotencyRecord, error)
+	// Complete stores the response for a reserved id for idempotencyTTL.
+	Complete(ctx context.Context, id string, statusCode int, contentType string, body []byte) error
+	// Release frees a reserved id so the request can be retried.
+	Release(ctx context.Context, id string) error
+}
+
+// mongoIdempotencyStore keeps the records in the IdempotencyKeys collection,
+// expired by a TTL index.
+type mongoIdempotencyStore struct {
+	client *mongo.Client
+}
+
+func newMongoIdempotencyStore(client *mongo.Client) *mongoIdempotencyStore {
+	return &mongoIdempotencyStore{client: client}
+}
+
+func (store *mongoIdempotencyStore) collection() *mongo.Collection {
+	return store.client.Database(dbName).Collection(idempotencyCollection)
+}
+
+// Reserve inserts the reservation, or takes over an expired record that the
+// TTL monitor, which only runs about once a minute, has not removed yet.
+func (store *mongoIdempotencyStore) Reserve(ctx context.Context, id, requestHash string) (*idempotencyRecord, error) {
+	now := time.Now()
+	// MongoDB stores times to the millisecond; truncating lets a retried write
+	// recognise the reservation its own earlier attempt made
+	reservation := idempotencyRecord{
+		ID:          id,
+		RequestHash: requestHash,
+		ExpiresAt:   now.Add(idempotencyLockTTL).Truncate(time.Millisecond),
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := withMongoRetry(ctx, func(ctx context.Context) error {
+			_, err := store.collection().InsertOne(ctx, reservation)
+			return err
+		})
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+
+		var result *mongo.UpdateResult
+		err = withMongoRetry(ctx, func(ctx context.Context) error {
+			var err error
+			result, err = store.collection().ReplaceOne(ctx,
+				bson.M{"_id": id, "expires_at": bson.M{"$lt": now}}, reservation)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount > 0 {
+			return nil, nil
+		}
+
+		var existing idempotencyRecord
+		err = withMongoRetry(ctx, func(ctx context.Context) error {
+			return store.collection().FindOne(ctx, bson.M{"_id": id}).Decode(&existing)
+		})
+		// The record expired and was removed since the insert, try again
+		if err == mongo.ErrNoDocuments && attempt < mongoRetryAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !existing.Completed && existing.RequestHash == requestHash && existing.ExpiresAt.Equal(reservation.ExpiresAt) {
+			return nil, nil
+		}
+		return &existing, nil
+	}
+}
+
+func (store *mongoIdempotencyStore) Complete(ctx context.Context, id string, statusCode int, contentType string, body []byte) error {
+	return withMongoRetry(ctx, func(ctx context.Context) error {
+		_, err := store.collection().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+			"completed":    true,
+			"status_code":  statusCode,
+			"content_type": contentType,
+			"body":         body,
+			"expires_at":   time.Now().Add(idempotencyTTL),
+		}})
+		return err
+	})
+}
+
+func (store *mongoIdempotencyStore) Release(ctx context.Context, id string) error {
+	return withMongoRetry(ctx, func(ctx context.Context) error {
+		_, err := store.collection().DeleteOne(ctx, bson.M{"_id": id})
+		return err
+	})
+}
+
+// memoryIdempotencyStore keeps the records in memory.
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]idempotencyRecord
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{records: make(map[string]idempotencyRecord)}
+}
+
+func (store *memoryIdempotencyStore) Reserve(ctx context.Context, id, requestHash string) (*idempotencyRecord, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	if existing, ok := store.records[id]; ok && now.Before(existing.ExpiresAt) {
+		return &existing, nil
+	}
+	store.records[id] = idempotencyRecord{ID: id, RequestHash: requestHash, ExpiresAt: now.Add(idempotencyLockTTL)}
+	return nil, nil
+}
+
+func (store *memoryIdempotencyStore) Complete(ctx context.Context, id string, statusCode int, contentType string, body []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	record, ok := store.records[id]
+	if !ok {
+		return nil
+	}
+	record.Completed = true
+	record.StatusCode = statusCode
+	record.ContentType = contentType
+	record.Body = append([]byte(nil), body...)
+	record.ExpiresAt = time.Now().Add(idempotencyTTL)
+	store.records[id] = record
+	return nil
+}
+
+func (store *memoryIdempotencyStore) Release(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.records, id)
+	return nil
+}
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	rec.statusCode = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// IdempotencyMiddleware honours the Idempotency-Key header. The first request
+// with a key runs normally and its response is stored for idempotencyTTL;
+// retries with the same key and body get the stored response replayed instead
+// of being processed again. Only successful responses are stored; after an
+// error (e.g. an expired form token) the key is released so the client can
+// fix the request and retry with it.
+func IdempotencyMiddleware(store IdempotencyStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > idempotencyMaxKeyLen {
+			writeError(w, ErrCodeIdempotencyKeyInvalid, "Idempotency-Key must be at most 255 characters", nil)
+			return
+		}
+
+		// Fingerprint the request so a key can't be reused for a different payload
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(sum[:])
+
+		ctx := r.Context()
+		id := r.Method + " " + r.URL.Path + " " + key
+
+		// Reserve the key; if it already exists, replay or reject
+		existing, err := store.Reserve(ctx, id, requestHash)
+		if err != nil {
+			internalError(w, r, "Failed to reserve idempotency key", err)
+			return
+		}
+		if existing != nil {
+			switch {
+			case existing.RequestHash != requestHash:
+				writeError(w, ErrCodeIdempotencyKeyReused, "Idempotency-Key was already used for a different request", nil)
+			case !existing.Completed:
+				writeError(w, ErrCodeIdempotencyInProgress, "A request with this Idempotency-Key is still being processed", nil)
+			default:
+				w.Header().Set("Content-Type", existing.ContentType)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.StatusCode)
+				w.Write(existing.Body)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// Store the outcome even if the client has gone away, that's exactly
+		// the case the retry will need it for
+		storeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if rec.statusCode >= 400 {
+			err = store.Release(storeCtx, id)
+		} else {
+			err = store.Complete(storeCtx, id, rec.statusCode, rec.Header().Get("Content-Type"), rec.body.Bytes())
+		}
+		if err != nil {
+			loggerFrom(ctx).Error("Failed to store idempotent response", "error", err)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexSetups lists everything that creates indexes the code depends on.
+// Creating an index that already exists with the same options is a no-op, so
+// these run on every start.
+var indexSetups = []struct {
+	name   string
+	ensure func(context.Context, *mongo.Client) error
+}{
+	{"enquiries", ensureEnquiryIndexes},
+	{"enquiry reference", ensureReferenceIndex},
+	{"form tokens", ensureFormTokenIndex},
+	{"idempotency keys", ensureIdempotencyIndex},
+}
+
+// ensureIndexes creates all indexes, logging failures rather than stopping
+// startup: the service still works without them, only slower or with weaker
+// guarantees.
+func ensureIndexes(ctx context.Context, client *mongo.Client) {
+	for _, setup := range indexSetups {
+		if err := setup.ensure(ctx, client); err != nil {
+			slog.Error("Failed to create indexes", "indexes", setup.name, "error", err)
+		}
+	}
+}
+
+// ensureEnquiryIndexes creates indexes for browsing enquiries by date and
+// type. Nothing in this service lists enquiries yet; they are added ahead of
+// admin listing endpoints and serve operators querying the collection
+// directly in the meantime.
+func ensureEnquiryIndexes(ctx context.Context, client *mongo.Client) error {
+	collection := client.Database(dbName).Collection(collectionName)
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "created_at", Value: -1}},
+			Options: options.Index().SetName("created_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "enquirytype", Value: 1}, {Key: "created_at", Value: -1}},
+			Options: options.Index().SetName("enquirytype_created_at"),
+		},
+	})
+	return err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type loggerKey struct{}
+
+// newLogger builds the application logger. LOG_FORMAT=json selects JSON output
+// for log aggregation; anything else gives human-readable key=value lines.
+// LOG_LEVEL (debug, info, warn, error) sets the minimum level, default info.
+func newLogger() *slog.Logger {
+	var level slog.Level
+	levelErr := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL")))
+	if levelErr != nil {
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if os.Getenv("LOG_FORMAT") == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	logger := slog.New(handler)
+	if levelErr != nil && os.Getenv("LOG_LEVEL") != "" {
+		logger.Warn("Invalid LOG_LEVEL, using info", "log_level", os.Getenv("LOG_LEVEL"))
+	}
+	return logger
+}
+
+// loggerFrom returns the request-scoped logger stored by loggingMiddleware,
+// falling back to the default logger.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// requestID returns the caller-supplied request ID, or a new random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 64 {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// loggingMiddleware assigns each request an ID, attaches a logger carrying it
+// to the request context and logs the request once it completes.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+
+		logger := slog.Default().With("request_id", id)
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger))
+
+		// Create a response writer that captures the status code
+		lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(lrw, r)
+
+		logger.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"proto", r.Proto,
+			"remote_addr", clientIP(r),
+			"status", lrw.statusCode,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// loggingResponseWriter is a custom ResponseWriter that captures the status code.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (lrw *loggingResponseWriter) WriteHeader(code int) {
+	lrw.statusCode = code
+	lrw.ResponseWriter.WriteHeader(code)
+}
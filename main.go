@@ -4,26 +4,42 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/getsentry/sentry-go"
 	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // Query struct to represent the data.
 type Query struct {
 	QueryID     primitive.ObjectID `json:"queryid" bson:"_id,omitempty"`
-	FirstName   string             `json:"first_name"`
-	LastName    string             `json:"last_name"`
-	Email       string             `json:"email"`
-	PhoneNumber string             `json:"phone_number"`
-	CompanyName string             `json:"company_name"`
-	EnquiryType string             `json:"enquiry_type"`
-	Message     string             `json:"message"`
+	Reference   string             `json:"reference" bson:"reference,omitempty"`
+	FirstName   string             `json:"first_name" validate:"required,max=100"`
+	LastName    string             `json:"last_name" validate:"max=100"`
+	Email       string             `json:"email" validate:"required,email,max=254"`
+	PhoneNumber string             `json:"phone_number" validate:"max=30"`
+	CompanyName string             `json:"company_name" validate:"max=200"`
+	EnquiryType string             `json:"enquiry_type" validate:"required,max=100"`
+	Message     string             `json:"message" validate:"required,max=2000"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+	DueAt       time.Time          `json:"due_at" bson:"due_at"`
+	Status      string             `json:"status" bson:"status"`
+	UpdatedAt   time.Time          `json:"updated_at" bson:"updated_at"`
+	// Lead attribution, as captured by the website form
+	Source      string `json:"source,omitempty" bson:"source,omitempty" validate:"max=200"`
+	UTMCampaign string `json:"utm_campaign,omitempty" bson:"utm_campaign,omitempty" validate:"max=200"`
+	UTMMedium   string `json:"utm_medium,omitempty" bson:"utm_medium,omitempty" validate:"max=200"`
+	UTMSource   string `json:"utm_source,omitempty" bson:"utm_source,omitempty" validate:"max=200"`
+	Referrer    string `json:"referrer,omitempty" bson:"referrer,omitempty" validate:"max=2000"`
+	// CustomFields holds values for the fields registered in the CustomFields collection.
+	CustomFields map[string]interface{} `json:"custom_fields,omitempty" bson:"custom_fields,omitempty"`
 }
 
 // MongoDB configuration
@@ -34,48 +50,146 @@ const (
 )
 
 func main() {
-	r := mux.NewRouter()
-	r.Use(CorsMiddleware)
-	// Add custom logging middleware
-	r.Use(loggingMiddleware)
-	r.Methods("OPTIONS").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.WriteHeader(http.StatusOK)
-	})
-	// Define API routes
-	r.HandleFunc("/enquiry", EnquiryHandler).Methods("POST")
-	r.HandleFunc("/", RootHandler).Methods("GET")
-	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURI))
+	slog.SetDefault(newLogger())
+	secret, err := loadFormTokenSecret()
+	if err != nil {
+		slog.Error("Failed to load form token secret", "error", err)
+		os.Exit(1)
+	}
+	formTokenSecret = secret
+	slaConfig = loadSLAConfig()
+	if err := initErrorReporting(); err != nil {
+		slog.Error("Invalid SENTRY_DSN", "error", err)
+		os.Exit(1)
+	}
+
+	// Rate limits are shared between instances through Redis when configured
+	redisClient, err := newRedisClient()
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("Invalid RATE_LIMIT_REDIS_URL", "error", err)
+		os.Exit(1)
 	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	err = client.Connect(ctx)
+	// One client, and so one connection pool, shared by all requests
+	dbConfig := loadDatabaseConfig()
+	slog.Info("MongoDB client settings", "mongo", dbConfig)
+	client, err := connectMongo(ctx, dbConfig)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("Failed to connect to MongoDB", "error", err)
+		os.Exit(1)
+	}
+
+	ensureIndexes(ctx, client)
+
+	r := newRouter(newMongoStores(client), redisClient)
+
+	srv := &http.Server{
+		Addr:              "0.0.0.0:8080",
+		Handler:           r,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Server is running", "addr", ":8080")
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	// Metrics go on a separate listener that is not exposed publicly
+	var metricsSrv *http.Server
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		metricsSrv = newMetricsServer(addr)
+		go func() {
+			slog.Info("Metrics server is running", "addr", addr)
+			if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+				slog.Error("Metrics server stopped", "error", err)
+			}
+		}()
+	}
+
+	// Serve until the platform asks us to stop, then drain in-flight requests
+	stop, stopNotify := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopNotify()
+	select {
+	case err := <-serveErr:
+		slog.Error("Server stopped", "error", err)
+		os.Exit(1)
+	case <-stop.Done():
 	}
-	defer client.Disconnect(ctx)
 
-	fmt.Println("Server is running on :8080")
-	log.Fatal(http.ListenAndServe("0.0.0.0:8080", r))
+	timeout := shutdownTimeout()
+	slog.Info("Shutting down, draining connections", "timeout", timeout)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), timeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to drain connections", "error", err)
+	}
+	if metricsSrv != nil {
+		metricsSrv.Shutdown(shutdownCtx)
+	}
+
+	// Close dependencies only once no request can use them any more
+	disconnectCtx, cancelDisconnect := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelDisconnect()
+	if err := client.Disconnect(disconnectCtx); err != nil {
+		slog.Error("Failed to disconnect from MongoDB", "error", err)
+	}
+	if redisClient != nil {
+		redisClient.Close()
+	}
+	sentry.Flush(2 * time.Second)
+	slog.Info("Server stopped")
 }
-func CorsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
 
-		next.ServeHTTP(w, r)
-	})
+// newRouter registers the routes and middleware. Handlers get their storage
+// from stores, so a router backed by newMemoryStores can be built for tests.
+func newRouter(stores Stores, redisClient *redis.Client) *mux.Router {
+	r := mux.NewRouter()
+	// Add custom logging middleware
+	r.Use(loggingMiddleware)
+	r.Use(ErrorReportingMiddleware)
+	r.Use(SlowRequestMiddleware(slowRequestThreshold(), newSlowRequestAlerter()))
+	r.Use(TimeoutMiddleware(requestTimeout))
+	rateLimit := RateLimitMiddleware(redisClient)
+
+	// Public routes used by the website form; CORS is applied per route group,
+	// ahead of rate limiting so that browsers can read 429 responses too
+	public := r.NewRoute().Subrouter()
+	public.Use(CorsMiddleware(loadCorsPolicy("CORS_PUBLIC", publicCorsPolicy)))
+	public.Use(rateLimit)
+	public.Handle("/enquiry", IdempotencyMiddleware(stores.Idempotency, EnquiryHandler(stores.Enquiries, stores.FormTokens, stores.CustomFields))).Methods("POST", "OPTIONS").Name("enquiry")
+	public.HandleFunc("/enquiry/token", FormTokenHandler).Methods("GET", "OPTIONS")
+	public.HandleFunc("/enquiry/fields", CustomFieldsHandler(stores.CustomFields)).Methods("GET", "OPTIONS")
+	public.HandleFunc("/enquiry/status/{reference}", EnquiryStatusHandler(stores.Enquiries)).Methods("GET", "OPTIONS").Name("enquiry-status")
+	public.HandleFunc("/", RootHandler).Methods("GET", "OPTIONS")
+
+	// Routes not called from browsers, so no CORS
+	platform := r.NewRoute().Subrouter()
+	platform.Use(rateLimit)
+
+	// Health probes for the platform
+	platform.HandleFunc("/health/live", HealthLiveHandler).Methods("GET")
+	platform.HandleFunc("/health/ready", HealthReadyHandler(stores.Ping, redisClient)).Methods("GET")
+
+	// API documentation
+	platform.HandleFunc("/openapi.json", OpenAPIHandler).Methods("GET")
+	platform.HandleFunc("/docs", DocsHandler).Methods("GET")
+
+	return r
 }
+
+// shutdownTimeout is how long to wait for in-flight requests on shutdown,
+// from SHUTDOWN_TIMEOUT (e.g. "15s"), default 10s.
+func shutdownTimeout() time.Duration {
+	timeout := 10 * time.Second
+	envPositiveDuration("SHUTDOWN_TIMEOUT", &timeout)
+	return timeout
+}
+
 func RootHandler(w http.ResponseWriter, r *http.Request) {
 	// Response message
 	message := "You have reached the end of the line...\nState your wish!!!"
@@ -85,80 +199,75 @@ func RootHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, message)
 }
-func EnquiryHandler(w http.ResponseWriter, r *http.Request) {
-	var q Query
-
-	// Parse JSON request body into the Query struct
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&q); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to decode JSON: %s", err.Error()), http.StatusBadRequest)
-		return
-	}
 
-	// Create a MongoDB client
-	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURI))
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to connect to MongoDB: %s", err.Error()), http.StatusInternalServerError)
-		return
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// EnquiryHandler accepts enquiries from the website form.
+func EnquiryHandler(enquiries EnquiryRepository, formTokens FormTokenStore, customFields CustomFieldRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var q Query
 
-	// Connect to MongoDB
-	err = client.Connect(ctx)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to connect to MongoDB: %s", err.Error()), http.StatusInternalServerError)
-		return
-	}
-	defer client.Disconnect(ctx)
+		// Validate the signed form token before doing any work
+		nonce, err := verifyFormToken(r.Header.Get(formTokenHeader), time.Now())
+		if err != nil {
+			loggerFrom(r.Context()).Debug("Rejected form token", "error", err)
+			writeError(w, formTokenErrorCode(err), fmt.Sprintf("Invalid form submission: %s", err.Error()), nil)
+			return
+		}
 
-	// Get a handle to the collection
-	collection := client.Database(dbName).Collection(collectionName)
+		// Parse and validate the JSON request body into the Query struct
+		if err := BindAndValidate(r, &q); err != nil {
+			badRequest(w, err)
+			return
+		}
 
-	// Insert the enquiry data into MongoDB
-	_, err = collection.InsertOne(ctx, q)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to insert data into MongoDB: %s", err.Error()), http.StatusInternalServerError)
-		return
-	}
+		// Stamp creation time and compute the SLA due date
+		q.CreatedAt = time.Now().UTC()
+		q.UpdatedAt = q.CreatedAt
+		q.DueAt = q.CreatedAt.Add(slaTarget(q.EnquiryType))
+		q.Status = EnquiryStatusNew
 
-	// Send a JSON response for success
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":  "success",
-		"message": "Thanks for reaching out. We will get back to you.",
-	})
-
-	// //Alternatively, send a JSON response for failure
-	// w.Header().Set("Content-Type", "application/json")
-	// w.WriteHeader(http.StatusInternalServerError)
-	// json.NewEncoder(w).Encode(map[string]interface{}{
-	// 	"status":  "error",
-	// 	"message": "Internal Server Error. Please try again later.",
-	// })
-}
+		ctx := r.Context()
 
-// loggingMiddleware is a custom middleware function for logging requests.
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		// Create a response writer that captures the status code and response size
-		lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		// Call the next handler in the chain
-		next.ServeHTTP(lrw, r)
-		// Log the request details and status code
-		fmt.Printf("[%s]'   '%s'   '%s'   '%s'   '%v'   '-'   '%d\n", r.Method, r.RemoteAddr, r.URL.Path, r.Proto, time.Since(start), lrw.statusCode)
-	})
-}
+		// Validate custom fields against the registry
+		defs, err := customFields.Definitions(ctx)
+		if err != nil {
+			internalError(w, r, "Failed to load custom fields", err)
+			return
+		}
+		if err := validateCustomFields(q.CustomFields, defs); err != nil {
+			badRequest(w, err)
+			return
+		}
 
-// loggingResponseWriter is a custom ResponseWriter that captures the status code.
-type loggingResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
+		// IDs and references are assigned by the store, never by the client
+		q.QueryID = primitive.NilObjectID
+		q.Reference = ""
 
-func (lrw *loggingResponseWriter) WriteHeader(code int) {
-	lrw.statusCode = code
-	lrw.ResponseWriter.WriteHeader(code)
-}
\ No newline at end of file
+		// Single-use the form token and store the enquiry under a human-readable
+		// reference in one transaction, so a failed insert doesn't burn the
+		// submitter's token or skip a reference
+		err = enquiries.RunInTransaction(ctx, func(ctx context.Context) error {
+			if err := formTokens.Consume(ctx, nonce, time.Now()); err != nil {
+				return err
+			}
+			return enquiries.Create(ctx, &q)
+		})
+		if err == errFormTokenUsed {
+			loggerFrom(r.Context()).Debug("Rejected form token", "error", err)
+			writeError(w, ErrCodeFormTokenUsed, fmt.Sprintf("Invalid form submission: %s", err.Error()), nil)
+			return
+		}
+		if err != nil {
+			internalError(w, r, "Failed to store enquiry", err)
+			return
+		}
+
+		// Send a JSON response for success
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":    "success",
+			"message":   "Thanks for reaching out. We will get back to you.",
+			"reference": q.Reference,
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimit is a token bucket allowing Burst requests at once, refilling at
+// Limit requests per Interval.
+type RateLimit struct {
+	Limit    int
+	Interval time.Duration
+	Burst    int
+}
+
+func (rl RateLimit) rate() float64 {
+	return float64(rl.Limit) / rl.Interval.Seconds()
+}
+
+// Rate limits. Routes are matched by name; unnamed routes use defaultRateLimit.
+var (
+	defaultRateLimit = RateLimit{Limit: 120, Interval: time.Minute, Burst: 60}
+
+	routeRateLimits = map[string]RateLimit{
+		// Public status lookups by reference code
+		"enquiry-status": {Limit: 10, Interval: time.Minute, Burst: 10},
+		// Enquiry submissions
+		"enquiry": {Limit: 5, Interval: time.Minute, Burst: 5},
+	}
+)
+
+// Limiter decides whether the client identified by key may make another request.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (LimitResult, error)
+}
+
+// LimitResult is the outcome of a Limiter check.
+type LimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // time until the next token when not allowed
+}
+
+// memoryLimiter is an in-memory token bucket limiter, suitable for a single instance.
+type memoryLimiter struct {
+	mu        sync.Mutex
+	limit     RateLimit
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newMemoryLimiter(limit RateLimit) *memoryLimiter {
+	return &memoryLimiter{
+		limit:   limit,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *memoryLimiter) Allow(ctx context.Context, key string) (LimitResult, error) {
+	return l.allow(key, time.Now()), nil
+}
+
+func (l *memoryLimiter) allow(key string, now time.Time) LimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	burst := float64(l.limit.Burst)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.rate())
+	b.last = now
+	if b.tokens < 1 {
+		return LimitResult{RetryAfter: time.Duration((1 - b.tokens) / l.limit.rate() * float64(time.Second))}
+	}
+	b.tokens--
+	return LimitResult{Allowed: true, Remaining: int(b.tokens)}
+}
+
+// sweep drops buckets that have refilled completely, so idle clients don't
+// accumulate in memory.
+func (l *memoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(float64(l.limit.Burst) / l.limit.rate() * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// redisTokenBucket atomically refills and takes a token from the bucket stored
+// in a hash at KEYS[1]. ARGV: rate (tokens/s), burst, now (ms).
+var redisTokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local data = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(data[1]) or burst
+local ts = tonumber(data[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000))
+return {allowed, tostring(tokens)}
+`)
+
+// redisLimiter shares token buckets between instances through Redis.
+type redisLimiter struct {
+	client *redis.Client
+	name   string
+	limit  RateLimit
+}
+
+func (l *redisLimiter) Allow(ctx context.Context, key string) (LimitResult, error) {
+	res, err := redisTokenBucket.Run(ctx, l.client,
+		[]string{"ratelimit:" + l.name + ":" + key},
+		l.limit.rate(), l.limit.Burst, time.Now().UnixMilli(),
+	).Slice()
+	if err != nil {
+		return LimitResult{}, err
+	}
+	allowed, _ := res[0].(int64)
+	tokensStr, _ := res[1].(string)
+	tokens, err := strconv.ParseFloat(tokensStr, 64)
+	if err != nil {
+		return LimitResult{}, err
+	}
+	if allowed == 0 {
+		return LimitResult{RetryAfter: time.Duration((1 - tokens) / l.limit.rate() * float64(time.Second))}, nil
+	}
+	return LimitResult{Allowed: true, Remaining: int(tokens)}, nil
+}
+
+// newLimiter returns a Redis-backed limiter when redisClient is set, so limits
+// hold across instances, and an in-memory one otherwise.
+func newLimiter(redisClient *redis.Client, name string, limit RateLimit) Limiter {
+	if redisClient != nil {
+		return &redisLimiter{client: redisClient, name: name, limit: limit}
+	}
+	return newMemoryLimiter(limit)
+}
+
+// newRedisClient connects to RATE_LIMIT_REDIS_URL, returning nil when it is not set.
+func newRedisClient() (*redis.Client, error) {
+	url := os.Getenv("RATE_LIMIT_REDIS_URL")
+	if url == "" {
+		return nil, nil
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(opts), nil
+}
+
+// clientIP returns the address of the client. On App Engine the front end
+// sets X-Appengine-User-IP, which clients cannot spoof.
+func clientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Appengine-User-IP"); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitMiddleware limits each client IP per route, using the route's
+// entry in routeRateLimits or defaultRateLimit. Requests over the limit get
+// 429 Too Many Requests with Retry-After. If the limiter backend fails the
+// request is allowed through rather than taking the API down.
+func RateLimitMiddleware(redisClient *redis.Client) mux.MiddlewareFunc {
+	defaultLimiter := newLimiter(redisClient, "default", defaultRateLimit)
+	routeLimiters := make(map[string]Limiter, len(routeRateLimits))
+	for name, limit := range routeRateLimits {
+		routeLimiters[name] = newLimiter(redisClient, name, limit)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// CORS preflights are answered without any work and don't count
+			if r.Method == "OPTIONS" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			limiter, limit := defaultLimiter, defaultRateLimit
+			if route := mux.CurrentRoute(r); route != nil {
+				if l, ok := routeLimiters[route.GetName()]; ok {
+					limiter, limit = l, routeRateLimits[route.GetName()]
+				}
+			}
+
+			res, err := limiter.Allow(r.Context(), clientIP(r))
+			if err != nil {
+				loggerFrom(r.Context()).Warn("Rate limiter unavailable", "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			if !res.Allowed {
+				retryAfter := int(math.Ceil(res.RetryAfter.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(res.RetryAfter).Unix(), 10))
+				writeError(w, ErrCodeRateLimited, fmt.Sprintf("Too many requests, retry in %d seconds", retryAfter), nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	countersCollection = "Counters"
+	referencePrefix    = "RGP"
+)
+
+// Enquiry statuses
+const (
+	EnquiryStatusNew = "new"
+)
+
+// nextReference returns the next human-readable enquiry reference, e.g.
+// RGP-2024-00123. Sequence numbers restart every year.
+func nextReference(ctx context.Context, client *mongo.Client, now time.Time) (string, error) {
+	collection := client.Database(dbName).Collection(countersCollection)
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": fmt.Sprintf("enquiry-%d", now.Year())},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%05d", referencePrefix, now.Year(), counter.Seq), nil
+}
+
+// ensureReferenceIndex enforces unique enquiry references.
+func ensureReferenceIndex(ctx context.Context, client *mongo.Client) error {
+	collection := client.Database(dbName).Collection(collectionName)
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "reference", Value: 1}},
+		Options: options.Index().SetUnique(true).SetSparse(true),
+	})
+	return err
+}
+
+// EnquiryStatusHandler lets a submitter look up their enquiry by reference.
+// Only the status and last-update time are exposed.
+func EnquiryStatusHandler(enquiries EnquiryRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reference := mux.Vars(r)["reference"]
+
+		status, err := enquiries.StatusByReference(r.Context(), reference)
+		if err == errEnquiryNotFound {
+			writeError(w, ErrCodeEnquiryNotFound, "Enquiry not found", nil)
+			return
+		}
+		if err != nil {
+			internalError(w, r, "Failed to load enquiry", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// errEnquiryNotFound is returned by EnquiryRepository lookups that match nothing.
+var errEnquiryNotFound = errors.New("enquiry not found")
+
+// EnquiryRepository stores and loads enquiries. Handlers depend on this
+// interface rather than on MongoDB, so the storage can be swapped out.
+type EnquiryRepository interface {
+	// RunInTransaction runs fn so that the writes made through ctx by this
+	// repository and the other stores commit or fail together. fn may be
+	// run more than once.
+	RunInTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+	// Create assigns q the next reference and stores it.
+	Create(ctx context.Context, q *Query) error
+	// StatusByReference returns the public status of the enquiry with the
+	// given reference, or errEnquiryNotFound. The submitter's details are
+	// not loaded.
+	StatusByReference(ctx context.Context, reference string) (*EnquiryStatus, error)
+}
+
+// EnquiryStatus is the part of an enquiry exposed by the public status lookup.
+type EnquiryStatus struct {
+	Reference string    `json:"reference" bson:"reference"`
+	Status    string    `json:"status" bson:"status"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// mongoEnquiryRepository is the EnquiryRepository backed by the Enquiries
+// collection.
+type mongoEnquiryRepository struct {
+	client *mongo.Client
+}
+
+func newMongoEnquiryRepository(client *mongo.Client) *mongoEnquiryRepository {
+	return &mongoEnquiryRepository{client: client}
+}
+
+func (repo *mongoEnquiryRepository) collection() *mongo.Collection {
+	return repo.client.Database(dbName).Collection(collectionName)
+}
+
+// RunInTransaction retries the whole transaction on transient errors that
+// session.WithTransaction gives up on, e.g. no primary being available.
+func (repo *mongoEnquiryRepository) RunInTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return withMongoRetry(ctx, func(ctx context.Context) error {
+		session, err := repo.client.StartSession()
+		if err != nil {
+			return err
+		}
+		defer session.EndSession(context.Background())
+		_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, fn(sc)
+		})
+		return err
+	})
+}
+
+// Create is meant to run inside RunInTransaction, which retries it.
+func (repo *mongoEnquiryRepository) Create(ctx context.Context, q *Query) error {
+	reference, err := nextReference(ctx, repo.client, q.CreatedAt)
+	if err != nil {
+		return err
+	}
+	q.Reference = reference
+	_, err = repo.collection().InsertOne(ctx, q)
+	return err
+}
+
+func (repo *mongoEnquiryRepository) StatusByReference(ctx context.Context, reference string) (*EnquiryStatus, error) {
+	var status EnquiryStatus
+	err := withMongoRetry(ctx, func(ctx context.Context) error {
+		return repo.collection().FindOne(ctx, bson.M{"reference": reference},
+			options.FindOne().SetProjection(bson.M{"_id": 0, "reference": 1, "status": 1, "updated_at": 1}),
+		).Decode(&status)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, errEnquiryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// memoryEnquiryRepository is an EnquiryRepository kept in memory, for running
+// handlers without MongoDB. References follow the same format and yearly
+// sequence as the Mongo implementation.
+type memoryEnquiryRepository struct {
+	mu          sync.RWMutex
+	byReference map[string]Query
+	counters    map[int]int64
+}
+
+func newMemoryEnquiryRepository() *memoryEnquiryRepository {
+	return &memoryEnquiryRepository{
+		byReference: make(map[string]Query),
+		counters:    make(map[int]int64),
+	}
+}
+
+// RunInTransaction runs fn once; the memory stores cannot fail part way.
+func (repo *memoryEnquiryRepository) RunInTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+func (repo *memoryEnquiryRepository) Create(ctx context.Context, q *Query) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	year := q.CreatedAt.Year()
+	repo.counters[year]++
+	q.QueryID = primitive.NewObjectID()
+	q.Reference = fmt.Sprintf("%s-%d-%05d", referencePrefix, year, repo.counters[year])
+	repo.byReference[q.Reference] = *q
+	return nil
+}
+
+func (repo *memoryEnquiryRepository) StatusByReference(ctx context.Context, reference string) (*EnquiryStatus, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	q, ok := repo.byReference[reference]
+	if !ok {
+		return nil, errEnquiryNotFound
+	}
+	return &EnquiryStatus{Reference: q.Reference, Status: q.Status, UpdatedAt: q.UpdatedAt}, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// MongoDB retry configuration. The driver already retries a failed read or
+// write once; this covers failures that outlast that, such as a primary
+// election.
+const (
+	mongoRetryAttempts = 3
+	mongoRetryBaseWait = 100 * time.Millisecond
+	mongoRetryMaxWait  = time.Second
+)
+
+// transientMongoCodes are server error codes raised while a replica set is
+// changing primary or a node is restarting.
+var transientMongoCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// isTransientMongoError reports whether err is worth retrying. Errors caused
+// by the request's own deadline or cancellation never are.
+func isTransientMongoError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+	var selectionErr topology.ServerSelectionError
+	if errors.As(err, &selectionErr) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		if serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError") {
+			return true
+		}
+		for _, code := range transientMongoCodes {
+			if serverErr.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withMongoRetry runs op, retrying transient errors up to mongoRetryAttempts
+// times with jittered exponential backoff. Inside a transaction op runs once:
+// the transaction as a whole is retried instead, see RunInTransaction.
+func withMongoRetry(ctx context.Context, op func(ctx context.Context) error) error {
+	if mongo.SessionFromContext(ctx) != nil {
+		return op(ctx)
+	}
+
+	wait := mongoRetryBaseWait
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if attempt == mongoRetryAttempts || !isTransientMongoError(err) {
+			return err
+		}
+		loggerFrom(ctx).Warn("Retrying MongoDB operation", "attempt", attempt, "error", err)
+
+		timer := time.NewTimer(wait/2 + time.Duration(rand.Int63n(int64(wait/2))))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if wait *= 2; wait > mongoRetryMaxWait {
+			wait = mongoRetryMaxWait
+		}
+	}
+}
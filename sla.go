@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// SLAConfig holds the response-time targets per enquiry type.
+type SLAConfig struct {
+	// Default applies to enquiry types without their own target.
+	Default time.Duration
+	// Targets is keyed by normalised enquiry type, see normaliseEnquiryType.
+	Targets map[string]time.Duration
+}
+
+// defaultSLAConfig can be overridden with SLA_DEFAULT_TARGET and SLA_TARGETS.
+var defaultSLAConfig = SLAConfig{
+	Default: 48 * time.Hour,
+	Targets: map[string]time.Duration{
+		"general inquiry": 48 * time.Hour,
+		"sales":           24 * time.Hour,
+		"support":         8 * time.Hour,
+	},
+}
+
+// slaConfig is the configuration in effect, set from loadSLAConfig in main.
+var slaConfig = defaultSLAConfig
+
+// loadSLAConfig applies environment overrides to defaultSLAConfig.
+// SLA_DEFAULT_TARGET is a duration (e.g. "36h"); SLA_TARGETS is a comma
+// separated list of type=duration pairs (e.g. "Sales=12h,Billing=24h") that
+// add to or replace the default targets. Invalid entries are logged and ignored.
+func loadSLAConfig() SLAConfig {
+	cfg := SLAConfig{Default: defaultSLAConfig.Default, Targets: make(map[string]time.Duration)}
+	for t, d := range defaultSLAConfig.Targets {
+		cfg.Targets[t] = d
+	}
+	envDuration("SLA_DEFAULT_TARGET", &cfg.Default)
+	for _, entry := range splitList(os.Getenv("SLA_TARGETS")) {
+		enquiryType, value, ok := strings.Cut(entry, "=")
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if !ok || err != nil || d <= 0 || normaliseEnquiryType(enquiryType) == "" {
+			slog.Warn("Invalid SLA_TARGETS entry, ignoring", "entry", entry)
+			continue
+		}
+		cfg.Targets[normaliseEnquiryType(enquiryType)] = d
+	}
+	return cfg
+}
+
+// normaliseEnquiryType makes free-text enquiry types comparable: case and
+// surrounding or repeated whitespace are ignored.
+func normaliseEnquiryType(enquiryType string) string {
+	return strings.ToLower(strings.Join(strings.Fields(enquiryType), " "))
+}
+
+// slaTarget returns the response-time target for the given enquiry type.
+func slaTarget(enquiryType string) time.Duration {
+	if d, ok := slaConfig.Targets[normaliseEnquiryType(enquiryType)]; ok {
+		return d
+	}
+	return slaConfig.Default
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Slow request configuration. The threshold can be overridden with
+// SLOW_REQUEST_THRESHOLD, the alert count with SLOW_REQUEST_ALERT_COUNT.
+const (
+	defaultSlowRequestThreshold  = 2 * time.Second
+	defaultSlowRequestAlertCount = 10
+	slowRequestAlertWindow       = time.Minute
+)
+
+// Slow request counters, served by the metrics server.
+var (
+	slowRequests        = expvar.NewInt("slow_requests")
+	slowRequestsByRoute = expvar.NewMap("slow_requests_by_route")
+)
+
+// newMetricsServer serves the slow request counters as JSON at /metrics. It
+// is meant for an internal address (METRICS_ADDR), not the public listener.
+func newMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{%q: %s, %q: %s}\n",
+			"slow_requests", slowRequests.String(),
+			"slow_requests_by_route", slowRequestsByRoute.String())
+	})
+	return &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: readHeaderTimeout}
+}
+
+type mongoTimingKey struct{}
+
+// mongoTiming accumulates the time a request spends in MongoDB commands.
+type mongoTiming struct {
+	mu        sync.Mutex
+	commands  int
+	total     time.Duration
+	byCommand map[string]time.Duration
+}
+
+func (t *mongoTiming) add(command string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.byCommand == nil {
+		t.byCommand = make(map[string]time.Duration)
+	}
+	t.commands++
+	t.total += d
+	t.byCommand[command] += d
+}
+
+// logValue summarises the timing for the slow request log line.
+func (t *mongoTiming) logValue() slog.Attr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slog.Group("mongo",
+		"commands", t.commands,
+		"duration", t.total,
+		"by_command", t.byCommand,
+	)
+}
+
+// mongoCommandMonitor adds each command's duration to the mongoTiming of the
+// request it ran for.
+var mongoCommandMonitor = &event.CommandMonitor{
+	Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+		recordMongoCommand(ctx, e.CommandFinishedEvent)
+	},
+	Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+		recordMongoCommand(ctx, e.CommandFinishedEvent)
+	},
+}
+
+func recordMongoCommand(ctx context.Context, e event.CommandFinishedEvent) {
+	if t, ok := ctx.Value(mongoTimingKey{}).(*mongoTiming); ok {
+		t.add(e.CommandName, e.Duration)
+	}
+}
+
+// slowRequestThreshold reads SLOW_REQUEST_THRESHOLD (e.g. "1500ms"), default 2s.
+func slowRequestThreshold() time.Duration {
+	threshold := defaultSlowRequestThreshold
+	envPositiveDuration("SLOW_REQUEST_THRESHOLD", &threshold)
+	return threshold
+}
+
+// routeLabel names the matched route for logs and metrics: its name if it has
+// one, otherwise its path template.
+func routeLabel(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return r.URL.Path
+	}
+	if name := route.GetName(); name != "" {
+		return name
+	}
+	if tpl, err := route.GetPathTemplate(); err == nil {
+		return tpl
+	}
+	return r.URL.Path
+}
+
+// SlowRequestMiddleware logs requests that take longer than threshold, with
+// the time spent in MongoDB, counts them per route and reports them to
+// alerter (which may be nil).
+func SlowRequestMiddleware(threshold time.Duration, alerter *slowRequestAlerter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			timing := &mongoTiming{}
+			r = r.WithContext(context.WithValue(r.Context(), mongoTimingKey{}, timing))
+
+			lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(lrw, r)
+
+			elapsed := time.Since(start)
+			if elapsed < threshold {
+				return
+			}
+			route := routeLabel(r)
+			slowRequests.Add(1)
+			slowRequestsByRoute.Add(route, 1)
+			loggerFrom(r.Context()).Warn("Slow request",
+				"route", route,
+				"status", lrw.statusCode,
+				"duration", elapsed,
+				"threshold", threshold,
+				timing.logValue(),
+			)
+			alerter.record(route, time.Now())
+		})
+	}
+}
+
+// slowRequestAlerter posts to a webhook when at least threshold slow
+// requests happen within slowRequestAlertWindow, at most once per window.
+type slowRequestAlerter struct {
+	webhookURL string
+	threshold  int
+	client     *http.Client
+
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int
+	alerted     bool
+}
+
+// newSlowRequestAlerter reads SLOW_REQUEST_ALERT_WEBHOOK and
+// SLOW_REQUEST_ALERT_COUNT. It returns nil, disabling alerts, when no webhook
+// is configured.
+func newSlowRequestAlerter() *slowRequestAlerter {
+	webhookURL := os.Getenv("SLOW_REQUEST_ALERT_WEBHOOK")
+	if webhookURL == "" {
+		return nil
+	}
+	threshold := defaultSlowRequestAlertCount
+	if v := os.Getenv("SLOW_REQUEST_ALERT_COUNT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && n > 0 {
+			threshold = n
+		} else {
+			slog.Warn("Invalid SLOW_REQUEST_ALERT_COUNT, using default", "value", v)
+		}
+	}
+	return &slowRequestAlerter{
+		webhookURL: webhookURL,
+		threshold:  threshold,
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (a *slowRequestAlerter) record(route string, now time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.windowStart) >= slowRequestAlertWindow {
+		a.windowStart = now
+		a.count = 0
+		a.alerted = false
+	}
+	a.count++
+	if a.count >= a.threshold && !a.alerted {
+		a.alerted = true
+		go a.send(a.count, route)
+	}
+}
+
+// send posts a Slack-compatible {"text": ...} payload to the webhook.
+func (a *slowRequestAlerter) send(count int, route string) {
+	payload, _ := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("RGP enquiry API: %d slow requests in the last %s (latest on %s)", count, slowRequestAlertWindow, route),
+	})
+	resp, err := a.client.Post(a.webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		slog.Error("Failed to send slow request alert", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Error("Slow request alert webhook failed", "status", resp.StatusCode)
+	}
+}
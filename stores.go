@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Stores holds the storage the handlers depend on, so that newRouter can be
+// built on MongoDB or, in tests, entirely in memory.
+type Stores struct {
+	Enquiries    EnquiryRepository
+	FormTokens   FormTokenStore
+	CustomFields CustomFieldRegistry
+	Idempotency  IdempotencyStore
+	// Ping checks the database for the readiness probe.
+	Ping func(ctx context.Context) error
+}
+
+// newMongoStores returns the MongoDB-backed stores.
+func newMongoStores(client *mongo.Client) Stores {
+	return Stores{
+		Enquiries:    newMongoEnquiryRepository(client),
+		FormTokens:   newMongoFormTokenStore(client),
+		CustomFields: newMongoCustomFieldRegistry(client),
+		Idempotency:  newMongoIdempotencyStore(client),
+		Ping: func(ctx context.Context) error {
+			return client.Ping(ctx, nil)
+		},
+	}
+}
+
+// newMemoryStores returns stores kept in memory, with customFields as the
+// registered custom fields.
+func newMemoryStores(customFields ...CustomFieldDefinition) Stores {
+	return Stores{
+		Enquiries:    newMemoryEnquiryRepository(),
+		FormTokens:   newMemoryFormTokenStore(),
+		CustomFields: memoryCustomFieldRegistry(customFields),
+		Idempotency:  newMemoryIdempotencyStore(),
+		Ping: func(ctx context.Context) error {
+			return nil
+		},
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// requestTimeout bounds how long a request, including its MongoDB work, may run.
+const requestTimeout = 10 * time.Second
+
+// Server timeouts, so slow or idle clients can't hold connections open.
+// Request bodies are small, so reading one gets no longer than handling it.
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = requestTimeout
+	idleTimeout       = 2 * time.Minute
+)
+
+// TimeoutMiddleware attaches a deadline to the request context. Handlers pass
+// r.Context() to MongoDB, so database work stops once the deadline passes or
+// the client goes away.
+func TimeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// maxRequestBodySize caps JSON request bodies.
+const maxRequestBodySize = 1 << 20
+
+// validate evaluates `validate` struct tags. Field errors are reported by
+// their JSON names.
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}
+
+// BindAndValidate decodes the JSON request body into dst and validates it
+// against its `validate` tags. Failures are returned as *RequestError.
+func BindAndValidate(r *http.Request, dst interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxRequestBodySize))
+	if err := decoder.Decode(dst); err != nil {
+		return &RequestError{Code: ErrCodeInvalidJSON, Message: fmt.Sprintf("Failed to decode JSON: %s", err.Error())}
+	}
+
+	if err := validate.Struct(dst); err != nil {
+		var validationErrs validator.ValidationErrors
+		if !errors.As(err, &validationErrs) {
+			return err
+		}
+		fields := make([]FieldError, 0, len(validationErrs))
+		for _, fe := range validationErrs {
+			fields = append(fields, FieldError{Field: fe.Field(), Message: fieldErrorMessage(fe)})
+		}
+		return &RequestError{Code: ErrCodeValidation, Message: "Validation failed", Fields: fields}
+	}
+	return nil
+}
+
+// fieldErrorMessage turns a failed validation rule into a readable message.
+func fieldErrorMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "max":
+		return fmt.Sprintf("must be at most %s characters", fe.Param())
+	case "min":
+		return fmt.Sprintf("must be at least %s characters", fe.Param())
+	case "url":
+		return "must be a valid URL"
+	default:
+		return fmt.Sprintf("failed the %q rule", fe.Tag())
+	}
+}